@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+)
+
+// Backend lets a message queue implementation register itself with proximo
+// so that it can be selected either as its own CLI subcommand (e.g. "kafka")
+// or, via --config, as one of several named backends in a multi-backend
+// deployment. Adding a new queue implementation (RabbitMQ, ...) should only
+// require implementing this interface and calling registerBackend, rather
+// than editing main(). Except for mem, whose subcommand shares a single
+// handler between consume and publish, RegisterCommand builds the CLI
+// subcommand on top of NewConsumeHandler/NewProduceHandler so the two setups
+// share one code path for turning configuration into a handler.
+type Backend interface {
+	Name() string
+	NewConsumeHandler(cfg map[string]string) (consumeHandler, error)
+	NewProduceHandler(cfg map[string]string) (produceHandler, error)
+	RegisterCommand(app *cli.Cli, enabled *map[string]bool, set func(consumeHandler, produceHandler))
+}
+
+var (
+	backendRegistry = map[string]Backend{}
+	backendOrder    []string
+)
+
+func registerBackend(b Backend) {
+	backendRegistry[b.Name()] = b
+	backendOrder = append(backendOrder, b.Name())
+}
+
+func lookupBackend(name string) (Backend, error) {
+	b, ok := backendRegistry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend type %q", name)
+	}
+	return b, nil
+}
+
+func init() {
+	registerBackend(kafkaBackend{})
+	registerBackend(natsStreamingBackend{})
+	registerBackend(memBackend{})
+	registerBackend(kinesisBackend{})
+	registerBackend(pulsarBackend{})
+}
+
+// durationMillisOrDefault parses s, a number of milliseconds, returning def
+// if s is empty or not a valid integer.
+func durationMillisOrDefault(s string, def time.Duration) time.Duration {
+	if s == "" {
+		return def
+	}
+	ms, err := strconv.Atoi(s)
+	if err != nil {
+		return def
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// intOrDefault parses s as an int, returning def if s is empty or not a
+// valid integer.
+func intOrDefault(s string, def int) int {
+	if s == "" {
+		return def
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func stringOrDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/uw-labs/proximo/proto"
+)
+
+// proximoConfig is the shape of the --config/-config proximo.yaml file. It
+// lets a single proximo process front several named backends and route
+// topics between them, instead of the one-backend-per-process model used by
+// the CLI subcommands.
+type proximoConfig struct {
+	Backends []backendInstanceConfig `yaml:"backends"`
+	Routes   []routeConfig           `yaml:"routes"`
+}
+
+type backendInstanceConfig struct {
+	Name   string            `yaml:"name"`
+	Type   string            `yaml:"type"`
+	Config map[string]string `yaml:"config"`
+}
+
+// routeConfig maps topics matching Match (a regular expression) to the
+// named backend instance. Routes are evaluated in order and the first match
+// wins.
+type routeConfig struct {
+	Match   string `yaml:"match"`
+	Backend string `yaml:"backend"`
+}
+
+func loadConfig(path string) (*proximoConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read config file")
+	}
+	var cfg proximoConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.Wrap(err, "failed to parse config file")
+	}
+	return &cfg, nil
+}
+
+// produceConfig mirrors consumerConfig for the publish side of the
+// protocol: the topic a client has asked to publish to.
+type produceConfig struct {
+	topic string
+}
+
+type route struct {
+	match   *regexp.Regexp
+	backend string
+}
+
+// switchingHandler dispatches HandleConsume/HandleProduce calls to one of a
+// set of named backend handlers, chosen by matching the requested topic
+// against a list of routes.
+type switchingHandler struct {
+	routes          []route
+	consumeHandlers map[string]consumeHandler
+	produceHandlers map[string]produceHandler
+}
+
+func newSwitchingHandler(cfg *proximoConfig) (*switchingHandler, error) {
+	sh := &switchingHandler{
+		consumeHandlers: make(map[string]consumeHandler),
+		produceHandlers: make(map[string]produceHandler),
+	}
+
+	for _, b := range cfg.Backends {
+		backend, err := lookupBackend(b.Type)
+		if err != nil {
+			return nil, errors.Wrapf(err, "backend %q", b.Name)
+		}
+		ch, err := backend.NewConsumeHandler(b.Config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "backend %q: failed to build consume handler", b.Name)
+		}
+		sh.consumeHandlers[b.Name] = ch
+
+		ph, err := backend.NewProduceHandler(b.Config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "backend %q: failed to build produce handler", b.Name)
+		}
+		sh.produceHandlers[b.Name] = ph
+	}
+
+	for _, r := range cfg.Routes {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid route match %q", r.Match)
+		}
+		if _, ok := sh.consumeHandlers[r.Backend]; !ok {
+			if _, ok := sh.produceHandlers[r.Backend]; !ok {
+				return nil, errors.Errorf("route references unknown backend %q", r.Backend)
+			}
+		}
+		sh.routes = append(sh.routes, route{match: re, backend: r.Backend})
+	}
+
+	return sh, nil
+}
+
+func (sh *switchingHandler) resolve(topic string) (string, error) {
+	for _, r := range sh.routes {
+		if r.match.MatchString(topic) {
+			return r.backend, nil
+		}
+	}
+	return "", errors.Errorf("no route matches topic %q", topic)
+}
+
+func (sh *switchingHandler) HandleConsume(ctx context.Context, conf consumerConfig, forClient chan<- *proto.Message, confirmRequest <-chan *proto.Confirmation, creditCh <-chan uint32) error {
+	name, err := sh.resolve(conf.topic)
+	if err != nil {
+		return err
+	}
+	handler, ok := sh.consumeHandlers[name]
+	if !ok {
+		return errors.Errorf("backend %q does not support consuming", name)
+	}
+	return handler.HandleConsume(ctx, conf, forClient, confirmRequest, creditCh)
+}
+
+func (sh *switchingHandler) HandleProduce(ctx context.Context, conf produceConfig, forClient <-chan *proto.Message, confirmRequest chan<- *proto.Confirmation) error {
+	name, err := sh.resolve(conf.topic)
+	if err != nil {
+		return err
+	}
+	handler, ok := sh.produceHandlers[name]
+	if !ok {
+		return errors.Errorf("backend %q does not support publishing", name)
+	}
+	return handler.HandleProduce(ctx, conf, forClient, confirmRequest)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func mustRoute(t *testing.T, match, backend string) route {
+	t.Helper()
+	re, err := regexp.Compile(match)
+	if err != nil {
+		t.Fatalf("failed to compile %q: %v", match, err)
+	}
+	return route{match: re, backend: backend}
+}
+
+func TestSwitchingHandlerResolveFirstMatchWins(t *testing.T) {
+	sh := &switchingHandler{
+		routes: []route{
+			mustRoute(t, "^orders\\.", "kafka"),
+			mustRoute(t, ".*", "kinesis"),
+		},
+	}
+
+	backend, err := sh.resolve("orders.created")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if backend != "kafka" {
+		t.Fatalf("got %q, want %q", backend, "kafka")
+	}
+
+	backend, err = sh.resolve("payments.created")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if backend != "kinesis" {
+		t.Fatalf("got %q, want %q", backend, "kinesis")
+	}
+}
+
+func TestSwitchingHandlerResolveNoMatchingRoute(t *testing.T) {
+	sh := &switchingHandler{
+		routes: []route{mustRoute(t, "^orders\\.", "kafka")},
+	}
+
+	if _, err := sh.resolve("payments.created"); err == nil {
+		t.Fatal("expected an error for a topic with no matching route")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import "context"
+
+// creditController implements the server side of proximo's flow-control
+// protocol: a backend handler is only allowed to hand the client `credit`
+// unacknowledged messages before it has to wait for a client-issued
+// FlowControl message to replenish it. An initial credit of zero means
+// unlimited, which keeps clients that predate FlowControl working exactly
+// as before.
+type creditController struct {
+	requests    chan chan struct{}
+	flowControl chan uint32
+}
+
+func newCreditController(ctx context.Context, initialCredit uint32) *creditController {
+	c := &creditController{
+		requests:    make(chan chan struct{}),
+		flowControl: make(chan uint32),
+	}
+	go c.run(ctx, initialCredit)
+	return c
+}
+
+func (c *creditController) run(ctx context.Context, initialCredit uint32) {
+	unlimited := initialCredit == 0
+	credit := initialCredit
+
+	var pending []chan struct{}
+
+	for {
+		var grant chan struct{}
+		if len(pending) > 0 && (unlimited || credit > 0) {
+			grant = pending[0]
+		}
+
+		select {
+		case req := <-c.requests:
+			pending = append(pending, req)
+		case n := <-c.flowControl:
+			unlimited = false
+			credit += n
+		case grant <- struct{}{}:
+			pending = pending[1:]
+			if !unlimited {
+				credit--
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// acquire blocks until a message may be sent to the client, or ctx is done.
+func (c *creditController) acquire(ctx context.Context) error {
+	req := make(chan struct{})
+	select {
+	case c.requests <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-req:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// addCredit replenishes the available credit by n, switching the
+// controller out of unlimited (legacy) mode the first time it is called.
+func (c *creditController) addCredit(ctx context.Context, n uint32) {
+	select {
+	case c.flowControl <- n:
+	case <-ctx.Done():
+	}
+}
+
+// coalesceCredit delivers n on ch without ever blocking or losing a credit
+// update: ch must be a single-slot buffered channel used by one writer. If
+// ch already holds an update the handler hasn't drained yet, that update is
+// folded into n before the send is retried, so a handler that is merely busy
+// (rather than genuinely gone) always eventually sees the full total.
+func coalesceCredit(ch chan uint32, n uint32) {
+	for {
+		select {
+		case ch <- n:
+			return
+		case prev := <-ch:
+			n += prev
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCreditControllerUnlimitedByDefault(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	c := newCreditController(ctx, 0)
+	for i := 0; i < 3; i++ {
+		if err := c.acquire(ctx); err != nil {
+			t.Fatalf("acquire %d: %v", i, err)
+		}
+	}
+}
+
+func TestCreditControllerBlocksUntilCreditAdded(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	c := newCreditController(ctx, 1)
+
+	if err := c.acquire(ctx); err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- c.acquire(ctx) }()
+
+	select {
+	case <-done:
+		t.Fatal("acquire returned before credit was available")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.addCredit(ctx, 1)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("acquire after addCredit: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire did not unblock after addCredit")
+	}
+}
+
+func TestCreditControllerAcquireReturnsErrorWhenContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newCreditController(ctx, 1)
+	if err := c.acquire(ctx); err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+
+	cancel()
+
+	if err := c.acquire(ctx); err == nil {
+		t.Fatal("expected acquire to fail once the context is done")
+	}
+}
+
+func TestCoalesceCreditDeliversSingleUpdate(t *testing.T) {
+	ch := make(chan uint32, 1)
+
+	coalesceCredit(ch, 2)
+
+	select {
+	case n := <-ch:
+		if n != 2 {
+			t.Fatalf("got %d, want 2", n)
+		}
+	default:
+		t.Fatal("expected a value to be delivered")
+	}
+}
+
+func TestCoalesceCreditFoldsPendingUpdate(t *testing.T) {
+	ch := make(chan uint32, 1)
+	ch <- 3
+
+	coalesceCredit(ch, 4)
+
+	select {
+	case n := <-ch:
+		if n != 7 {
+			t.Fatalf("got %d, want 7 (3 pending + 4 new)", n)
+		}
+	default:
+		t.Fatal("expected a folded value to be delivered")
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	cli "github.com/jawher/mow.cli"
+	"github.com/pkg/errors"
+
+	"github.com/uw-labs/proximo/proto"
+)
+
+func kafkaConfigFrom(cfg map[string]string) ([]string, *sarama.KafkaVersion, kafkaTLSConfig, kafkaSASLConfig, error) {
+	brokerString := cfg["brokers"]
+	if brokerString == "" {
+		brokerString = "localhost:9092"
+	}
+	brokers := strings.Split(brokerString, ",")
+
+	var version *sarama.KafkaVersion
+	if v := cfg["version"]; v != "" {
+		kv, err := sarama.ParseKafkaVersion(v)
+		if err != nil {
+			return nil, nil, kafkaTLSConfig{}, kafkaSASLConfig{}, errors.Wrap(err, "failed to parse kafka version")
+		}
+		version = &kv
+	}
+
+	tlsCfg := kafkaTLSConfig{
+		caFile:             cfg["tls_ca"],
+		certFile:           cfg["tls_cert"],
+		keyFile:            cfg["tls_key"],
+		insecureSkipVerify: cfg["tls_insecure_skip_verify"] == "true",
+	}
+	saslCfg := kafkaSASLConfig{
+		mechanism: cfg["sasl_mechanism"],
+		user:      cfg["sasl_user"],
+		password:  cfg["sasl_password"],
+	}
+
+	return brokers, version, tlsCfg, saslCfg, nil
+}
+
+// kafkaConsumerGroupConfigFrom parses the consumer-group tuning options
+// shared by the --config-driven kafka backend and the "kafka" CLI
+// subcommand. Every value is optional: a zero duration/size leaves the
+// corresponding sarama default in place, except a zero commit interval,
+// which commits offsets synchronously on every confirmation.
+func kafkaConsumerGroupConfigFrom(cfg map[string]string) (assignor string, sessionTimeout, heartbeatInterval, rebalanceTimeout time.Duration, fetchMinBytes int32, fetchMaxWait, commitInterval time.Duration) {
+	assignor = stringOrDefault(cfg["assignor"], "range")
+	sessionTimeout = durationMillisOrDefault(cfg["session_timeout_ms"], 0)
+	heartbeatInterval = durationMillisOrDefault(cfg["heartbeat_interval_ms"], 0)
+	rebalanceTimeout = durationMillisOrDefault(cfg["rebalance_timeout_ms"], 0)
+	fetchMinBytes = int32(intOrDefault(cfg["fetch_min_bytes"], 0))
+	fetchMaxWait = durationMillisOrDefault(cfg["fetch_max_wait_ms"], 0)
+	commitInterval = durationMillisOrDefault(cfg["commit_interval_ms"], 0)
+	return
+}
+
+// kafkaTLSConfig holds the paths/flags needed to build a *tls.Config for
+// talking to a TLS-enabled Kafka cluster.
+type kafkaTLSConfig struct {
+	caFile             string
+	certFile           string
+	keyFile            string
+	insecureSkipVerify bool
+}
+
+func (c kafkaTLSConfig) enabled() bool {
+	return c.caFile != "" || c.certFile != "" || c.insecureSkipVerify
+}
+
+func (c kafkaTLSConfig) build() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.insecureSkipVerify}
+
+	if c.caFile != "" {
+		caCert, err := ioutil.ReadFile(c.caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read kafka tls CA")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("failed to parse kafka tls CA")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load kafka tls client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// kafkaSASLConfig holds the flags needed to configure SASL authentication
+// against a Kafka cluster.
+type kafkaSASLConfig struct {
+	mechanism string
+	user      string
+	password  string
+}
+
+func (c kafkaSASLConfig) enabled() bool {
+	return c.mechanism != ""
+}
+
+func applyKafkaNetConfig(config *sarama.Config, tlsCfg kafkaTLSConfig, saslCfg kafkaSASLConfig) error {
+	if tlsCfg.enabled() {
+		t, err := tlsCfg.build()
+		if err != nil {
+			return err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = t
+	}
+
+	if saslCfg.enabled() {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = saslCfg.user
+		config.Net.SASL.Password = saslCfg.password
+
+		switch saslCfg.mechanism {
+		case "PLAIN":
+			config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case "SCRAM-SHA-256":
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			config.Net.SASL.SCRAMClientGeneratorFunc = scramClientGenerator(sarama.SASLTypeSCRAMSHA256)
+		case "SCRAM-SHA-512":
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			config.Net.SASL.SCRAMClientGeneratorFunc = scramClientGenerator(sarama.SASLTypeSCRAMSHA512)
+		default:
+			return errors.Errorf("unsupported sasl mechanism %q", saslCfg.mechanism)
+		}
+	}
+
+	return nil
+}
+
+// kafkaAssignors maps the --assignor CLI values to the sarama balance
+// strategies available for consumer group partition assignment.
+var kafkaAssignors = map[string]sarama.BalanceStrategy{
+	"":                   sarama.NewBalanceStrategyRange(),
+	"range":              sarama.NewBalanceStrategyRange(),
+	"roundrobin":         sarama.NewBalanceStrategyRoundRobin(),
+	"sticky":             sarama.NewBalanceStrategySticky(),
+	"cooperative-sticky": sarama.NewBalanceStrategyCooperativeSticky(),
+}
+
+// kafkaConsumeHandler consumes a topic as a member of a sarama consumer
+// group, so that partitions are shared between every proximo process
+// consuming with the same consumer name.
+type kafkaConsumeHandler struct {
+	brokers []string
+	version *sarama.KafkaVersion
+	tls     kafkaTLSConfig
+	sasl    kafkaSASLConfig
+
+	assignor          string
+	sessionTimeout    time.Duration
+	heartbeatInterval time.Duration
+	rebalanceTimeout  time.Duration
+	fetchMinBytes     int32
+	fetchMaxWait      time.Duration
+	commitInterval    time.Duration
+}
+
+func (h *kafkaConsumeHandler) newConfig(conf consumerConfig) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	if h.version != nil {
+		config.Version = *h.version
+	}
+	if err := applyKafkaNetConfig(config, h.tls, h.sasl); err != nil {
+		return nil, err
+	}
+
+	strategy, ok := kafkaAssignors[h.assignor]
+	if !ok {
+		return nil, errors.Errorf("unsupported assignor %q", h.assignor)
+	}
+	config.Consumer.Group.Rebalance.Strategy = strategy
+
+	if h.sessionTimeout > 0 {
+		config.Consumer.Group.Session.Timeout = h.sessionTimeout
+	}
+	if h.heartbeatInterval > 0 {
+		config.Consumer.Group.Heartbeat.Interval = h.heartbeatInterval
+	}
+	if h.rebalanceTimeout > 0 {
+		config.Consumer.Group.Rebalance.Timeout = h.rebalanceTimeout
+	}
+	if h.fetchMinBytes > 0 {
+		config.Consumer.Fetch.Min = h.fetchMinBytes
+	}
+	if h.fetchMaxWait > 0 {
+		config.Consumer.MaxWaitTime = h.fetchMaxWait
+	}
+
+	config.Consumer.Offsets.AutoCommit.Enable = false
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	if conf.offset == proto.Offset_OFFSET_NEWEST {
+		config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	}
+
+	return config, nil
+}
+
+func (h *kafkaConsumeHandler) HandleConsume(ctx context.Context, conf consumerConfig, forClient chan<- *proto.Message, confirmRequest <-chan *proto.Confirmation, creditCh <-chan uint32) error {
+	config, err := h.newConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	group, err := sarama.NewConsumerGroup(h.brokers, conf.consumer, config)
+	if err != nil {
+		return errors.Wrap(err, "failed to create kafka consumer group")
+	}
+	defer group.Close()
+
+	go func() {
+		for err := range group.Errors() {
+			log.Printf("kafka consumer group %s/%s error: %v", conf.consumer, conf.topic, err)
+		}
+	}()
+
+	// Flow control is left entirely to the global creditController in
+	// server_source.go, which gates every message relayed from the shared
+	// handlerForClient channel to the client, regardless of which
+	// partition's ConsumeClaim produced it. ConsumeClaim itself does not track credit locally: sarama
+	// runs one ConsumeClaim goroutine per assigned partition, and a single
+	// client-issued FlowControl value would otherwise replenish only
+	// whichever one partition happened to be listening on creditCh.
+	groupHandler := &kafkaGroupHandler{
+		forClient:      forClient,
+		confirmRequest: confirmRequest,
+		commitInterval: h.commitInterval,
+	}
+
+	for ctx.Err() == nil {
+		if err := group.Consume(ctx, []string{conf.topic}, groupHandler); err != nil {
+			if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+				return nil
+			}
+			return errors.Wrap(err, "kafka consumer group session ended with error")
+		}
+	}
+	return nil
+}
+
+// kafkaGroupHandler implements sarama.ConsumerGroupHandler, relaying claimed
+// messages to the client and marking/committing offsets as confirmations
+// come back.
+type kafkaGroupHandler struct {
+	forClient      chan<- *proto.Message
+	confirmRequest <-chan *proto.Confirmation
+	commitInterval time.Duration
+}
+
+// Setup is called once a generation's partitions have been assigned, after
+// sarama has fetched each partition's last committed offset as part of
+// JoinGroup/SyncGroup and before any ConsumeClaim for this generation runs.
+// That ordering is what guarantees a rebalance can't hand a newly-assigned
+// partition to this consumer ahead of the previous owner's offset commits
+// for it propagating, so there is nothing further for proximo to do here.
+func (h *kafkaGroupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// Cleanup is called once ConsumeClaim has returned for every claim in the
+// generation, before the partitions are relinquished in the rebalance. With
+// commitInterval > 0, ConsumeClaim only commits periodically, so any offsets
+// MarkMessage'd since the last tick must be force-committed here - otherwise
+// the next owner starts from the stale committed offset and redelivers
+// messages the client already confirmed.
+func (h *kafkaGroupHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	session.Commit()
+	return nil
+}
+
+func (h *kafkaGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	ctx := session.Context()
+
+	var commitTick <-chan time.Time
+	if h.commitInterval > 0 {
+		ticker := time.NewTicker(h.commitInterval)
+		defer ticker.Stop()
+		commitTick = ticker.C
+	}
+
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			select {
+			case h.forClient <- &proto.Message{Data: msg.Value}:
+			case <-ctx.Done():
+				return nil
+			}
+
+			select {
+			case <-h.confirmRequest:
+				session.MarkMessage(msg, "")
+				if h.commitInterval == 0 {
+					session.Commit()
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		case <-commitTick:
+			session.Commit()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// kafkaProduceHandler publishes messages to a topic using a sarama sync
+// producer.
+type kafkaProduceHandler struct {
+	brokers []string
+	version *sarama.KafkaVersion
+	tls     kafkaTLSConfig
+	sasl    kafkaSASLConfig
+	backend string
+}
+
+func (h *kafkaProduceHandler) HandleProduce(ctx context.Context, conf produceConfig, forClient <-chan *proto.Message, confirmRequest chan<- *proto.Confirmation) error {
+	config := sarama.NewConfig()
+	if h.version != nil {
+		config.Version = *h.version
+	}
+	config.Producer.Return.Successes = true
+	if err := applyKafkaNetConfig(config, h.tls, h.sasl); err != nil {
+		return err
+	}
+
+	producer, err := sarama.NewSyncProducer(h.brokers, config)
+	if err != nil {
+		return errors.Wrap(err, "failed to create kafka producer")
+	}
+	defer producer.Close()
+
+	for {
+		select {
+		case m, ok := <-forClient:
+			if !ok {
+				return nil
+			}
+			_, _, err := producer.SendMessage(&sarama.ProducerMessage{
+				Topic: conf.topic,
+				Value: sarama.ByteEncoder(m.Data),
+			})
+			if err != nil {
+				return errors.Wrap(err, "failed to send message to kafka")
+			}
+			messagesOut.WithLabelValues(h.backend, conf.topic).Inc()
+			select {
+			case confirmRequest <- &proto.Confirmation{}:
+			case <-ctx.Done():
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+type kafkaBackend struct{}
+
+func (kafkaBackend) Name() string { return "kafka" }
+
+func (kafkaBackend) NewConsumeHandler(cfg map[string]string) (consumeHandler, error) {
+	brokers, version, tlsCfg, saslCfg, err := kafkaConfigFrom(cfg)
+	if err != nil {
+		return nil, err
+	}
+	assignor, sessionTimeout, heartbeatInterval, rebalanceTimeout, fetchMinBytes, fetchMaxWait, commitInterval := kafkaConsumerGroupConfigFrom(cfg)
+	return &kafkaConsumeHandler{
+		brokers:           brokers,
+		version:           version,
+		tls:               tlsCfg,
+		sasl:              saslCfg,
+		assignor:          assignor,
+		sessionTimeout:    sessionTimeout,
+		heartbeatInterval: heartbeatInterval,
+		rebalanceTimeout:  rebalanceTimeout,
+		fetchMinBytes:     fetchMinBytes,
+		fetchMaxWait:      fetchMaxWait,
+		commitInterval:    commitInterval,
+	}, nil
+}
+
+func (b kafkaBackend) NewProduceHandler(cfg map[string]string) (produceHandler, error) {
+	brokers, version, tlsCfg, saslCfg, err := kafkaConfigFrom(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaProduceHandler{brokers: brokers, version: version, tls: tlsCfg, sasl: saslCfg, backend: b.Name()}, nil
+}
+
+func (b kafkaBackend) RegisterCommand(app *cli.Cli, enabled *map[string]bool, set func(consumeHandler, produceHandler)) {
+	app.Command("kafka", "Use kafka backend", func(cmd *cli.Cmd) {
+		brokerString := cmd.String(cli.StringOpt{
+			Name:   "brokers",
+			Value:  "localhost:9092",
+			Desc:   "Broker addresses e.g., \"server1:9092,server2:9092\"",
+			EnvVar: "PROXIMO_KAFKA_BROKERS",
+		})
+		kafkaVersion := cmd.String(cli.StringOpt{
+			Name:   "version",
+			Desc:   "Kafka Version e.g. 1.1.1, 0.10.2.0",
+			EnvVar: "PROXIMO_KAFKA_VERSION",
+		})
+		tlsCA := cmd.String(cli.StringOpt{
+			Name:   "tls-ca",
+			Desc:   "Path to a PEM encoded CA certificate used to verify the broker",
+			EnvVar: "PROXIMO_KAFKA_TLS_CA",
+		})
+		tlsCert := cmd.String(cli.StringOpt{
+			Name:   "tls-cert",
+			Desc:   "Path to a PEM encoded client certificate, for mutual TLS",
+			EnvVar: "PROXIMO_KAFKA_TLS_CERT",
+		})
+		tlsKey := cmd.String(cli.StringOpt{
+			Name:   "tls-key",
+			Desc:   "Path to the PEM encoded private key for --tls-cert",
+			EnvVar: "PROXIMO_KAFKA_TLS_KEY",
+		})
+		tlsInsecureSkipVerify := cmd.Bool(cli.BoolOpt{
+			Name:   "tls-insecure-skip-verify",
+			Value:  false,
+			Desc:   "Skip verification of the broker's TLS certificate",
+			EnvVar: "PROXIMO_KAFKA_TLS_INSECURE_SKIP_VERIFY",
+		})
+		saslMechanism := cmd.String(cli.StringOpt{
+			Name:   "sasl-mechanism",
+			Desc:   "SASL mechanism to use (PLAIN, SCRAM-SHA-256, SCRAM-SHA-512)",
+			EnvVar: "PROXIMO_KAFKA_SASL_MECHANISM",
+		})
+		saslUser := cmd.String(cli.StringOpt{
+			Name:   "sasl-user",
+			Desc:   "SASL username",
+			EnvVar: "PROXIMO_KAFKA_SASL_USER",
+		})
+		saslPassword := cmd.String(cli.StringOpt{
+			Name:   "sasl-password",
+			Desc:   "SASL password",
+			EnvVar: "PROXIMO_KAFKA_SASL_PASSWORD",
+		})
+		assignor := cmd.String(cli.StringOpt{
+			Name:   "assignor",
+			Value:  "range",
+			Desc:   "Consumer group partition assignment strategy (range, roundrobin, sticky, cooperative-sticky)",
+			EnvVar: "PROXIMO_KAFKA_ASSIGNOR",
+		})
+		sessionTimeout := cmd.Int(cli.IntOpt{
+			Name:   "session-timeout",
+			Desc:   "Consumer group session timeout in milliseconds (0 uses the sarama default)",
+			EnvVar: "PROXIMO_KAFKA_SESSION_TIMEOUT_MS",
+		})
+		heartbeatInterval := cmd.Int(cli.IntOpt{
+			Name:   "heartbeat-interval",
+			Desc:   "Consumer group heartbeat interval in milliseconds (0 uses the sarama default)",
+			EnvVar: "PROXIMO_KAFKA_HEARTBEAT_INTERVAL_MS",
+		})
+		rebalanceTimeout := cmd.Int(cli.IntOpt{
+			Name:   "rebalance-timeout",
+			Desc:   "Consumer group rebalance timeout in milliseconds (0 uses the sarama default)",
+			EnvVar: "PROXIMO_KAFKA_REBALANCE_TIMEOUT_MS",
+		})
+		fetchMinBytes := cmd.Int(cli.IntOpt{
+			Name:   "fetch-min-bytes",
+			Desc:   "Minimum number of bytes the broker should return for a fetch request (0 uses the sarama default)",
+			EnvVar: "PROXIMO_KAFKA_FETCH_MIN_BYTES",
+		})
+		fetchMaxWait := cmd.Int(cli.IntOpt{
+			Name:   "fetch-max-wait",
+			Desc:   "Maximum time in milliseconds the broker should wait for --fetch-min-bytes to accumulate (0 uses the sarama default)",
+			EnvVar: "PROXIMO_KAFKA_FETCH_MAX_WAIT_MS",
+		})
+		commitInterval := cmd.Int(cli.IntOpt{
+			Name:   "commit-interval",
+			Desc:   "Commit offsets on this interval in milliseconds, instead of synchronously on every confirmation",
+			EnvVar: "PROXIMO_KAFKA_COMMIT_INTERVAL_MS",
+		})
+
+		cmd.Action = func() {
+			cfg := map[string]string{
+				"brokers":                  *brokerString,
+				"version":                  *kafkaVersion,
+				"tls_ca":                   *tlsCA,
+				"tls_cert":                 *tlsCert,
+				"tls_key":                  *tlsKey,
+				"tls_insecure_skip_verify": strconv.FormatBool(*tlsInsecureSkipVerify),
+				"sasl_mechanism":           *saslMechanism,
+				"sasl_user":                *saslUser,
+				"sasl_password":            *saslPassword,
+				"assignor":                 *assignor,
+				"session_timeout_ms":       strconv.Itoa(*sessionTimeout),
+				"heartbeat_interval_ms":    strconv.Itoa(*heartbeatInterval),
+				"rebalance_timeout_ms":     strconv.Itoa(*rebalanceTimeout),
+				"fetch_min_bytes":          strconv.Itoa(*fetchMinBytes),
+				"fetch_max_wait_ms":        strconv.Itoa(*fetchMaxWait),
+				"commit_interval_ms":       strconv.Itoa(*commitInterval),
+			}
+
+			var c consumeHandler
+			var p produceHandler
+			if (*enabled)[consumeEndpoint] {
+				h, err := b.NewConsumeHandler(cfg)
+				if err != nil {
+					log.Fatalf("failed to build kafka consume handler: %v", err)
+				}
+				c = h
+			}
+			if (*enabled)[publishEndpoint] {
+				h, err := b.NewProduceHandler(cfg)
+				if err != nil {
+					log.Fatalf("failed to build kafka produce handler: %v", err)
+				}
+				p = h
+			}
+			set(c, p)
+
+			log.Printf("Using kafka at %s\n", *brokerString)
+		}
+	})
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	cli "github.com/jawher/mow.cli"
+	"github.com/pkg/errors"
+	"github.com/uw-labs/sync/gogroup"
+
+	"github.com/uw-labs/proximo/proto"
+)
+
+const kinesisPollInterval = time.Second
+
+type kinesisCheckpoint struct {
+	shardID        string
+	sequenceNumber string
+}
+
+// kinesisConsumeHandler consumes all shards of a Kinesis stream, optionally
+// persisting per-shard sequence numbers to a DynamoDB table so that a
+// consumer's position survives restarts.
+type kinesisConsumeHandler struct {
+	region          string
+	stream          string
+	profile         string
+	checkpointTable string
+}
+
+func (h *kinesisConsumeHandler) HandleConsume(ctx context.Context, conf consumerConfig, forClient chan<- *proto.Message, confirmRequest <-chan *proto.Confirmation, creditCh <-chan uint32) error {
+	sess, err := kinesisSession(h.region, h.profile)
+	if err != nil {
+		return errors.Wrap(err, "failed to create aws session")
+	}
+	client := kinesis.New(sess)
+
+	var ddb *dynamodb.DynamoDB
+	if h.checkpointTable != "" {
+		ddb = dynamodb.New(sess)
+	}
+
+	shards, err := listShards(client, h.stream)
+	if err != nil {
+		return errors.Wrap(err, "failed to list shards")
+	}
+
+	// pending tracks, in the order messages were handed to the client, which
+	// shard and sequence number each outstanding message came from. The
+	// consume protocol only exposes a single confirmation stream back from
+	// the client, so acks are matched to shards on a strict FIFO basis.
+	var (
+		mu      sync.Mutex
+		pending []kinesisCheckpoint
+	)
+
+	g, ctx := gogroup.New(ctx)
+
+	for _, shard := range shards {
+		shard := shard
+		g.Go(func() error {
+			return h.consumeShard(ctx, client, ddb, conf, shard, forClient, &mu, &pending)
+		})
+	}
+
+	g.Go(func() error {
+		for {
+			select {
+			case <-confirmRequest:
+				mu.Lock()
+				if len(pending) == 0 {
+					mu.Unlock()
+					return errInvalidConfirm
+				}
+				cp := pending[0]
+				pending = pending[1:]
+				mu.Unlock()
+
+				if ddb != nil {
+					if err := h.checkpoint(ddb, conf.consumer, cp.shardID, cp.sequenceNumber); err != nil {
+						return errors.Wrap(err, "failed to checkpoint to dynamodb")
+					}
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+
+	return g.Wait()
+}
+
+func (h *kinesisConsumeHandler) consumeShard(ctx context.Context, client *kinesis.Kinesis, ddb *dynamodb.DynamoDB, conf consumerConfig, shard *kinesis.Shard, forClient chan<- *proto.Message, mu *sync.Mutex, pending *[]kinesisCheckpoint) error {
+	shardID := aws.StringValue(shard.ShardId)
+
+	iterator, err := h.startingIterator(client, ddb, conf, shardID)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(kinesisPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		out, err := client.GetRecordsWithContext(ctx, &kinesis.GetRecordsInput{
+			ShardIterator: aws.String(iterator),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to get records from shard %s", shardID)
+		}
+
+		for _, rec := range out.Records {
+			// mu must stay held across both the checkpoint append and the
+			// send to forClient: pending is only a valid FIFO record of
+			// send order if no other shard's goroutine can interleave an
+			// append and a send of its own in between.
+			mu.Lock()
+			*pending = append(*pending, kinesisCheckpoint{shardID: shardID, sequenceNumber: aws.StringValue(rec.SequenceNumber)})
+			select {
+			case forClient <- &proto.Message{Data: rec.Data}:
+				mu.Unlock()
+			case <-ctx.Done():
+				mu.Unlock()
+				return nil
+			}
+		}
+
+		if out.NextShardIterator == nil {
+			// the shard has been closed and fully drained
+			return nil
+		}
+		iterator = aws.StringValue(out.NextShardIterator)
+	}
+}
+
+func (h *kinesisConsumeHandler) startingIterator(client *kinesis.Kinesis, ddb *dynamodb.DynamoDB, conf consumerConfig, shardID string) (string, error) {
+	if ddb != nil {
+		if seq, ok, err := h.loadCheckpoint(ddb, conf.consumer, shardID); err != nil {
+			return "", err
+		} else if ok {
+			out, err := client.GetShardIterator(&kinesis.GetShardIteratorInput{
+				StreamName:             aws.String(h.stream),
+				ShardId:                aws.String(shardID),
+				ShardIteratorType:      aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber),
+				StartingSequenceNumber: aws.String(seq),
+			})
+			if err != nil {
+				return "", err
+			}
+			return aws.StringValue(out.ShardIterator), nil
+		}
+	}
+
+	iterType := kinesis.ShardIteratorTypeTrimHorizon
+	if conf.offset == proto.Offset_OFFSET_NEWEST {
+		iterType = kinesis.ShardIteratorTypeLatest
+	}
+
+	out, err := client.GetShardIterator(&kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(h.stream),
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: aws.String(iterType),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.ShardIterator), nil
+}
+
+func (h *kinesisConsumeHandler) loadCheckpoint(ddb *dynamodb.DynamoDB, consumer, shardID string) (string, bool, error) {
+	out, err := ddb.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(h.checkpointTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"consumer_shard": {S: aws.String(consumer + ":" + shardID)},
+		},
+	})
+	if err != nil {
+		return "", false, err
+	}
+	if out.Item == nil {
+		return "", false, nil
+	}
+	seq, ok := out.Item["sequence_number"]
+	if !ok || seq.S == nil {
+		return "", false, nil
+	}
+	return *seq.S, true, nil
+}
+
+func (h *kinesisConsumeHandler) checkpoint(ddb *dynamodb.DynamoDB, consumer, shardID, sequenceNumber string) error {
+	_, err := ddb.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(h.checkpointTable),
+		Item: map[string]*dynamodb.AttributeValue{
+			"consumer_shard":  {S: aws.String(consumer + ":" + shardID)},
+			"sequence_number": {S: aws.String(sequenceNumber)},
+		},
+	})
+	return err
+}
+
+// kinesisProduceHandler writes messages to a Kinesis stream, batching
+// records via PutRecords to improve throughput.
+type kinesisProduceHandler struct {
+	region    string
+	stream    string
+	profile   string
+	batchSize int
+	linger    time.Duration
+	backend   string
+}
+
+func (h *kinesisProduceHandler) HandleProduce(ctx context.Context, conf produceConfig, forClient <-chan *proto.Message, confirmRequest chan<- *proto.Confirmation) error {
+	sess, err := kinesisSession(h.region, h.profile)
+	if err != nil {
+		return errors.Wrap(err, "failed to create aws session")
+	}
+	client := kinesis.New(sess)
+
+	batch := make([]*proto.Message, 0, h.batchSize)
+	timer := time.NewTimer(h.linger)
+	defer timer.Stop()
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := h.putRecords(ctx, client, batch); err != nil {
+			return err
+		}
+		messagesOut.WithLabelValues(h.backend, conf.topic).Add(float64(len(batch)))
+		for range batch {
+			select {
+			case confirmRequest <- &proto.Confirmation{}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		select {
+		case m, ok := <-forClient:
+			if !ok {
+				return flush()
+			}
+			batch = append(batch, m)
+			if len(batch) >= h.batchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+				timer.Reset(h.linger)
+			}
+		case <-timer.C:
+			if err := flush(); err != nil {
+				return err
+			}
+			timer.Reset(h.linger)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (h *kinesisProduceHandler) putRecords(ctx context.Context, client *kinesis.Kinesis, batch []*proto.Message) error {
+	entries := make([]*kinesis.PutRecordsRequestEntry, len(batch))
+	for i, m := range batch {
+		key, err := randomPartitionKey()
+		if err != nil {
+			return errors.Wrap(err, "failed to generate partition key")
+		}
+		entries[i] = &kinesis.PutRecordsRequestEntry{
+			Data:         m.Data,
+			PartitionKey: aws.String(key),
+		}
+	}
+
+	out, err := client.PutRecordsWithContext(ctx, &kinesis.PutRecordsInput{
+		StreamName: aws.String(h.stream),
+		Records:    entries,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to put records")
+	}
+	if aws.Int64Value(out.FailedRecordCount) > 0 {
+		return fmt.Errorf("failed to put %d of %d records", aws.Int64Value(out.FailedRecordCount), len(batch))
+	}
+	return nil
+}
+
+// randomPartitionKey returns a random Kinesis partition key, so that records
+// are spread evenly across shards rather than hashing to the same handful of
+// shards batch after batch.
+func randomPartitionKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func kinesisSession(region, profile string) (*session.Session, error) {
+	opts := session.Options{
+		Config: aws.Config{Region: aws.String(region)},
+	}
+	if profile != "" {
+		opts.Profile = profile
+	}
+	return session.NewSessionWithOptions(opts)
+}
+
+func listShards(client *kinesis.Kinesis, stream string) ([]*kinesis.Shard, error) {
+	var shards []*kinesis.Shard
+	err := client.ListShardsPages(&kinesis.ListShardsInput{
+		StreamName: aws.String(stream),
+	}, func(out *kinesis.ListShardsOutput, lastPage bool) bool {
+		shards = append(shards, out.Shards...)
+		return true
+	})
+	return shards, err
+}
+
+type kinesisBackend struct{}
+
+func (kinesisBackend) Name() string { return "kinesis" }
+
+func (kinesisBackend) NewConsumeHandler(cfg map[string]string) (consumeHandler, error) {
+	if cfg["stream"] == "" {
+		return nil, fmt.Errorf("kinesis backend requires a \"stream\" config value")
+	}
+	return &kinesisConsumeHandler{
+		region:          cfg["region"],
+		stream:          cfg["stream"],
+		profile:         cfg["profile"],
+		checkpointTable: cfg["checkpoint_table"],
+	}, nil
+}
+
+func (b kinesisBackend) NewProduceHandler(cfg map[string]string) (produceHandler, error) {
+	if cfg["stream"] == "" {
+		return nil, fmt.Errorf("kinesis backend requires a \"stream\" config value")
+	}
+	return &kinesisProduceHandler{
+		region:    cfg["region"],
+		stream:    cfg["stream"],
+		profile:   cfg["profile"],
+		batchSize: intOrDefault(cfg["batch_size"], 500),
+		linger:    durationMillisOrDefault(cfg["linger_ms"], 100*time.Millisecond),
+		backend:   b.Name(),
+	}, nil
+}
+
+func (b kinesisBackend) RegisterCommand(app *cli.Cli, enabled *map[string]bool, set func(consumeHandler, produceHandler)) {
+	app.Command("kinesis", "Use AWS Kinesis backend", func(cmd *cli.Cmd) {
+		region := cmd.String(cli.StringOpt{
+			Name:   "region",
+			Value:  "us-east-1",
+			Desc:   "AWS region",
+			EnvVar: "PROXIMO_KINESIS_REGION",
+		})
+		stream := cmd.String(cli.StringOpt{
+			Name:   "stream",
+			Desc:   "Kinesis stream name",
+			EnvVar: "PROXIMO_KINESIS_STREAM",
+		})
+		profile := cmd.String(cli.StringOpt{
+			Name:   "profile",
+			Desc:   "AWS credentials profile",
+			EnvVar: "PROXIMO_KINESIS_PROFILE",
+		})
+		checkpointTable := cmd.String(cli.StringOpt{
+			Name:   "checkpoint-table",
+			Desc:   "DynamoDB table used to persist consumer group offsets (optional)",
+			EnvVar: "PROXIMO_KINESIS_CHECKPOINT_TABLE",
+		})
+		batchSize := cmd.Int(cli.IntOpt{
+			Name:   "batch-size",
+			Value:  500,
+			Desc:   "Maximum number of records to send in a single PutRecords call",
+			EnvVar: "PROXIMO_KINESIS_BATCH_SIZE",
+		})
+		lingerMs := cmd.Int(cli.IntOpt{
+			Name:   "linger-ms",
+			Value:  100,
+			Desc:   "Maximum time in milliseconds to wait for a full batch before publishing",
+			EnvVar: "PROXIMO_KINESIS_LINGER_MS",
+		})
+
+		cmd.Action = func() {
+			if *stream == "" {
+				log.Fatal("kinesis stream name is required")
+			}
+
+			cfg := map[string]string{
+				"region":           *region,
+				"stream":           *stream,
+				"profile":          *profile,
+				"checkpoint_table": *checkpointTable,
+				"batch_size":       strconv.Itoa(*batchSize),
+				"linger_ms":        strconv.Itoa(*lingerMs),
+			}
+
+			var c consumeHandler
+			var p produceHandler
+			if (*enabled)[consumeEndpoint] {
+				h, err := b.NewConsumeHandler(cfg)
+				if err != nil {
+					log.Fatalf("failed to build kinesis consume handler: %v", err)
+				}
+				c = h
+			}
+			if (*enabled)[publishEndpoint] {
+				h, err := b.NewProduceHandler(cfg)
+				if err != nil {
+					log.Fatalf("failed to build kinesis produce handler: %v", err)
+				}
+				p = h
+			}
+			set(c, p)
+
+			log.Printf("Using kinesis stream %s in region %s\n", *stream, *region)
+		}
+	})
+}
@@ -1,20 +1,27 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/Shopify/sarama"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	cli "github.com/jawher/mow.cli"
-	stan "github.com/nats-io/go-nats-streaming"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 
 	"github.com/uw-labs/proximo/proto"
@@ -27,9 +34,10 @@ const (
 
 func main() {
 	var (
-		cHandler consumeHandler
-		pHandler produceHandler
-		enabled  map[string]bool
+		cHandler    consumeHandler
+		pHandler    produceHandler
+		enabled     map[string]bool
+		backendName string
 	)
 
 	app := cli.App("proximo", "GRPC Proxy gateway for message queue systems")
@@ -48,124 +56,101 @@ func main() {
 		EnvVar: "PROXIMO_ENDPOINTS",
 	})
 
-	app.Before = func() {
-		enabled = parseEndpoints(*endpoints)
-	}
+	metricsPort := app.Int(cli.IntOpt{
+		Name:   "metrics-port",
+		Value:  9100,
+		Desc:   "Port to serve Prometheus metrics and pprof on (0 to disable)",
+		EnvVar: "PROXIMO_METRICS_PORT",
+	})
 
-	app.Command("kafka", "Use kafka backend", func(cmd *cli.Cmd) {
-		brokerString := cmd.String(cli.StringOpt{
-			Name:   "brokers",
-			Value:  "localhost:9092",
-			Desc:   "Broker addresses e.g., \"server1:9092,server2:9092\"",
-			EnvVar: "PROXIMO_KAFKA_BROKERS",
-		})
-		kafkaVersion := cmd.String(cli.StringOpt{
-			Name:   "version",
-			Desc:   "Kafka Version e.g. 1.1.1, 0.10.2.0",
-			EnvVar: "PROXIMO_KAFKA_VERSION",
-		})
+	enablePprof := app.Bool(cli.BoolOpt{
+		Name:   "pprof",
+		Value:  false,
+		Desc:   "Expose /debug/pprof/* on the metrics port",
+		EnvVar: "PROXIMO_PPROF",
+	})
 
-		cmd.Action = func() {
-			brokers := strings.Split(*brokerString, ",")
+	configFile := app.String(cli.StringOpt{
+		Name:   "config",
+		Desc:   "Path to a proximo.yaml config file, used when no backend subcommand is given. It allows several named backends to be fronted by one proximo process, with topics routed between them. When a backend subcommand is given, this is ignored.",
+		EnvVar: "PROXIMO_CONFIG",
+	})
 
-			var version *sarama.KafkaVersion
-			if kafkaVersion != nil && *kafkaVersion != "" {
-				kv, err := sarama.ParseKafkaVersion(*kafkaVersion)
-				if err != nil {
-					log.Fatalf("failed to parse kafka version: %v ", err)
-				}
-				version = &kv
-			}
+	grpcTLSCert := app.String(cli.StringOpt{
+		Name:   "grpc-tls-cert",
+		Desc:   "Path to a PEM encoded certificate used to serve the gRPC listener over TLS",
+		EnvVar: "PROXIMO_GRPC_TLS_CERT",
+	})
+	grpcTLSKey := app.String(cli.StringOpt{
+		Name:   "grpc-tls-key",
+		Desc:   "Path to the PEM encoded private key for --grpc-tls-cert",
+		EnvVar: "PROXIMO_GRPC_TLS_KEY",
+	})
+	grpcClientCA := app.String(cli.StringOpt{
+		Name:   "grpc-client-ca",
+		Desc:   "Path to a PEM encoded CA certificate. When set, clients must present a certificate signed by this CA",
+		EnvVar: "PROXIMO_GRPC_CLIENT_CA",
+	})
 
-			if enabled[consumeEndpoint] {
-				cHandler = &kafkaConsumeHandler{
-					brokers: brokers,
-					version: version,
-				}
-			}
-			if enabled[publishEndpoint] {
-				pHandler = &kafkaProduceHandler{
-					brokers: brokers,
-					version: version,
-				}
-			}
+	grpcAuthToken := app.String(cli.StringOpt{
+		Name:   "grpc-auth-token",
+		Desc:   "Bearer token callers must present in the \"authorization\" metadata. When unset, no authorization check is performed",
+		EnvVar: "PROXIMO_GRPC_AUTH_TOKEN",
+	})
 
-			log.Printf("Using kafka at %s\n", brokers)
+	app.Before = func() {
+		enabled = parseEndpoints(*endpoints)
+	}
+
+	app.Action = func() {
+		if *configFile == "" {
+			log.Fatal("either a backend subcommand or --config must be given")
 		}
-	})
 
-	app.Command("nats-streaming", "Use NATS streaming backend", func(cmd *cli.Cmd) {
-		url := cmd.String(cli.StringOpt{
-			Name:   "url",
-			Value:  "nats://localhost:4222",
-			Desc:   "NATS url",
-			EnvVar: "PROXIMO_NATS_URL",
-		})
-		cid := cmd.String(cli.StringOpt{
-			Name:   "cid",
-			Value:  "test-cluster",
-			Desc:   "cluster id",
-			EnvVar: "PROXIMO_NATS_CLUSTER_ID",
-		})
-		maxInflight := cmd.Int(cli.IntOpt{
-			Name:   "max-inflight",
-			Value:  stan.DefaultMaxInflight,
-			Desc:   "maximum number of unacknowledged messages",
-			EnvVar: "PROXIMO_NATS_MAX_INFLIGHT",
-		})
-		pingIntervalSeconds := cmd.Int(cli.IntOpt{
-			Name:   "ping-interval",
-			Value:  3,
-			Desc:   "interval in seconds for connection pings",
-			EnvVar: "PROXIMO_NATS_PING_INTERVAL_SECONDS",
-		})
-		pingNumTimeouts := cmd.Int(cli.IntOpt{
-			Name:   "num-ping-timeouts",
-			Value:  5,
-			Desc:   "number of pings to time out before connection considered broken",
-			EnvVar: "PROXIMO_NATS_NUM_PING_TIMEOUTS",
-		})
-		cmd.Action = func() {
-			if enabled[consumeEndpoint] {
-				h, err := newNatsStreamingConsumeHandler(*url, *cid, *maxInflight, *pingIntervalSeconds, *pingNumTimeouts)
-				if err != nil {
-					log.Fatalf("failed to connect to nats streaming for consumption: %v", err)
-				}
-				cHandler = h
-				defer h.Close()
-			}
-			if enabled[publishEndpoint] {
-				h, err := newNatsStreamingProduceHandler(*url, *cid, *maxInflight, *pingIntervalSeconds, *pingNumTimeouts)
-				if err != nil {
-					log.Fatalf("failed to connect to nats streaming for production: %v", err)
-				}
-				pHandler = h
-				defer h.Close()
-			}
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("failed to load config: %v", err)
+		}
 
-			log.Printf("Using NATS streaming server at %s with cluster id %s and max inflight %v\n", *url, *cid, *maxInflight)
+		sh, err := newSwitchingHandler(cfg)
+		if err != nil {
+			log.Fatalf("failed to build backends from config: %v", err)
 		}
-	})
 
-	app.Command("mem", "Use in-memory testing backend", func(cmd *cli.Cmd) {
-		cmd.Action = func() {
-			h := newMemHandler()
+		backendName = "config"
+		if enabled[consumeEndpoint] {
+			cHandler = sh
+		}
+		if enabled[publishEndpoint] {
+			pHandler = sh
+		}
+
+		log.Printf("Using %d backend(s) from config file %s\n", len(cfg.Backends), *configFile)
+	}
 
-			if enabled[consumeEndpoint] {
-				cHandler = h
+	for _, name := range backendOrder {
+		name := name
+		b := backendRegistry[name]
+		b.RegisterCommand(app, &enabled, func(c consumeHandler, p produceHandler) {
+			backendName = name
+			if c != nil {
+				cHandler = c
 			}
-			if enabled[publishEndpoint] {
-				pHandler = h
+			if p != nil {
+				pHandler = p
 			}
-
-			log.Printf("Using in memory testing backend")
-		}
-	})
+		})
+	}
 
 	if err := app.Run(os.Args); err != nil {
 		log.Fatal(err)
 	}
-	log.Fatal(listenAndServe(cHandler, pHandler, *port))
+	serverTLS := grpcServerTLSConfig{
+		certFile: *grpcTLSCert,
+		keyFile:  *grpcTLSKey,
+		clientCA: *grpcClientCA,
+	}
+	log.Fatal(listenAndServe(cHandler, pHandler, backendName, *port, *metricsPort, *enablePprof, serverTLS, *grpcAuthToken))
 }
 
 func parseEndpoints(endpoints string) map[string]bool {
@@ -183,26 +168,109 @@ func parseEndpoints(endpoints string) map[string]bool {
 
 	return enabled
 }
-func listenAndServe(cHandler consumeHandler, pHandler produceHandler, port int) error {
+
+// grpcServerTLSConfig holds the flags needed to serve the gRPC listener over
+// TLS, optionally requiring and verifying a client certificate (mTLS).
+type grpcServerTLSConfig struct {
+	certFile string
+	keyFile  string
+	clientCA string
+}
+
+func (c grpcServerTLSConfig) enabled() bool {
+	return c.certFile != ""
+}
+
+func (c grpcServerTLSConfig) build() (credentials.TransportCredentials, error) {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load grpc tls certificate")
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if c.clientCA != "" {
+		caCert, err := ioutil.ReadFile(c.clientCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read grpc client CA")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("failed to parse grpc client CA")
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+func listenAndServe(cHandler consumeHandler, pHandler produceHandler, backendName string, port, metricsPort int, enablePprof bool, serverTLS grpcServerTLSConfig, authToken string) error {
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return errors.Wrap(err, "failed to listen")
 	}
 	defer lis.Close()
 
+	var auth authorizer = noopAuthorizer{}
+	if authToken != "" {
+		auth = staticTokenAuthorizer{token: authToken}
+	}
+
 	opts := []grpc.ServerOption{
 		grpc.KeepaliveParams(keepalive.ServerParameters{
 			Time: 5 * time.Minute,
 		}),
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
+			grpc_prometheus.StreamServerInterceptor,
+			streamAuthInterceptor(auth),
+		)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
+			grpc_prometheus.UnaryServerInterceptor,
+			unaryAuthInterceptor(auth),
+		)),
+	}
+
+	if serverTLS.enabled() {
+		creds, err := serverTLS.build()
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(creds))
 	}
+
 	grpcServer := grpc.NewServer(opts...)
 	defer grpcServer.Stop()
 
 	if cHandler != nil {
-		proto.RegisterMessageSourceServer(grpcServer, &consumeServer{handler: cHandler})
+		proto.RegisterMessageSourceServer(grpcServer, &consumeServer{backend: backendName, handler: cHandler})
 	}
 	if pHandler != nil {
-		proto.RegisterMessageSinkServer(grpcServer, &produceServer{handler: pHandler})
+		proto.RegisterMessageSinkServer(grpcServer, &produceServer{backend: backendName, handler: pHandler})
+	}
+	grpc_prometheus.Register(grpcServer)
+
+	if metricsPort > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		if enablePprof {
+			mux.HandleFunc("/debug/pprof/", pprof.Index)
+			mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+			mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+			mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+			mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		}
+
+		adminServer := &http.Server{
+			Addr:    fmt.Sprintf(":%d", metricsPort),
+			Handler: mux,
+		}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("admin server failed: %v", err)
+			}
+		}()
+		defer adminServer.Close()
 	}
 
 	errCh := make(chan error, 1)
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	messagesIn = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "proximo",
+		Name:      "messages_in_total",
+		Help:      "Total number of messages received from a backend for consumption.",
+	}, []string{"backend", "topic"})
+
+	messagesInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "proximo",
+		Name:      "messages_in_flight",
+		Help:      "Number of messages currently awaiting confirmation.",
+	}, []string{"backend", "topic"})
+
+	confirmLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "proximo",
+		Name:      "confirm_latency_seconds",
+		Help:      "Time between a message being handed to a client and its confirmation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "topic"})
+
+	handlerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "proximo",
+		Name:      "handler_errors_total",
+		Help:      "Total number of errors returned by a backend handler.",
+	}, []string{"backend", "topic"})
+
+	messagesOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "proximo",
+		Name:      "messages_out_total",
+		Help:      "Total number of messages published to a backend.",
+	}, []string{"backend", "topic"})
+)
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+
+	cli "github.com/jawher/mow.cli"
+	stan "github.com/nats-io/go-nats-streaming"
+	"github.com/pkg/errors"
+
+	"github.com/uw-labs/proximo/proto"
+)
+
+func natsStreamingConfigFrom(cfg map[string]string) (url, cid string, maxInflight, pingInterval, pingTimeouts int) {
+	url = stringOrDefault(cfg["url"], "nats://localhost:4222")
+	cid = stringOrDefault(cfg["cid"], "test-cluster")
+	maxInflight = intOrDefault(cfg["max_inflight"], stan.DefaultMaxInflight)
+	pingInterval = intOrDefault(cfg["ping_interval"], 3)
+	pingTimeouts = intOrDefault(cfg["num_ping_timeouts"], 5)
+	return
+}
+
+func natsStreamingConnect(url, cid, clientID string, maxInflight, pingInterval, pingTimeouts int) (stan.Conn, error) {
+	return stan.Connect(cid, clientID,
+		stan.NatsURL(url),
+		stan.Pings(pingInterval, pingTimeouts),
+		stan.MaxPubAcksInflight(maxInflight),
+	)
+}
+
+// natsStreamingConsumeHandler consumes a subject via a durable, queue-group
+// NATS streaming subscription, acking each message only once the client has
+// confirmed it.
+type natsStreamingConsumeHandler struct {
+	url          string
+	cid          string
+	maxInflight  int
+	pingInterval int
+	pingTimeouts int
+}
+
+func newNatsStreamingConsumeHandler(url, cid string, maxInflight, pingInterval, pingTimeouts int) (*natsStreamingConsumeHandler, error) {
+	return &natsStreamingConsumeHandler{
+		url:          url,
+		cid:          cid,
+		maxInflight:  maxInflight,
+		pingInterval: pingInterval,
+		pingTimeouts: pingTimeouts,
+	}, nil
+}
+
+func natsStartOpt(offset proto.Offset) stan.SubscriptionOption {
+	if offset == proto.Offset_OFFSET_NEWEST {
+		return stan.StartWithLastReceived()
+	}
+	return stan.DeliverAllAvailable()
+}
+
+// HandleConsume ignores creditCh: the global creditController in
+// server_source.go already blocks the single relay goroutine from pulling a
+// further message out of forClient until the client has credit, which is
+// enough to stop this subscription's callback outrunning the client - there
+// is no per-partition concern here like there is for kafka.
+func (h *natsStreamingConsumeHandler) HandleConsume(ctx context.Context, conf consumerConfig, forClient chan<- *proto.Message, confirmRequest <-chan *proto.Confirmation, creditCh <-chan uint32) error {
+	conn, err := natsStreamingConnect(h.url, h.cid, conf.consumer+"-consumer", h.maxInflight, h.pingInterval, h.pingTimeouts)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to nats streaming")
+	}
+	defer conn.Close()
+
+	msgCh := make(chan *stan.Msg)
+	sub, err := conn.QueueSubscribe(conf.topic, conf.consumer, func(m *stan.Msg) {
+		select {
+		case msgCh <- m:
+		case <-ctx.Done():
+		}
+	},
+		stan.DurableName(conf.consumer),
+		stan.SetManualAckMode(),
+		stan.MaxInflight(h.maxInflight),
+		natsStartOpt(conf.offset),
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to subscribe to nats streaming subject")
+	}
+	defer sub.Close()
+
+	for {
+		select {
+		case m := <-msgCh:
+			select {
+			case forClient <- &proto.Message{Data: m.Data}:
+			case <-ctx.Done():
+				return nil
+			}
+			select {
+			case <-confirmRequest:
+				if err := m.Ack(); err != nil {
+					return errors.Wrap(err, "failed to ack nats streaming message")
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// natsStreamingProduceHandler publishes messages to a NATS streaming
+// subject, confirming each one synchronously once the broker has stored it.
+type natsStreamingProduceHandler struct {
+	url          string
+	cid          string
+	maxInflight  int
+	pingInterval int
+	pingTimeouts int
+	backend      string
+}
+
+func newNatsStreamingProduceHandler(url, cid string, maxInflight, pingInterval, pingTimeouts int, backend string) (*natsStreamingProduceHandler, error) {
+	return &natsStreamingProduceHandler{
+		url:          url,
+		cid:          cid,
+		maxInflight:  maxInflight,
+		pingInterval: pingInterval,
+		pingTimeouts: pingTimeouts,
+		backend:      backend,
+	}, nil
+}
+
+func (h *natsStreamingProduceHandler) HandleProduce(ctx context.Context, conf produceConfig, forClient <-chan *proto.Message, confirmRequest chan<- *proto.Confirmation) error {
+	conn, err := natsStreamingConnect(h.url, h.cid, conf.topic+"-producer", h.maxInflight, h.pingInterval, h.pingTimeouts)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to nats streaming")
+	}
+	defer conn.Close()
+
+	for {
+		select {
+		case m, ok := <-forClient:
+			if !ok {
+				return nil
+			}
+			if err := conn.Publish(conf.topic, m.Data); err != nil {
+				return errors.Wrap(err, "failed to publish message to nats streaming")
+			}
+			messagesOut.WithLabelValues(h.backend, conf.topic).Inc()
+			select {
+			case confirmRequest <- &proto.Confirmation{}:
+			case <-ctx.Done():
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+type natsStreamingBackend struct{}
+
+func (natsStreamingBackend) Name() string { return "nats-streaming" }
+
+func (natsStreamingBackend) NewConsumeHandler(cfg map[string]string) (consumeHandler, error) {
+	url, cid, maxInflight, pingInterval, pingTimeouts := natsStreamingConfigFrom(cfg)
+	return newNatsStreamingConsumeHandler(url, cid, maxInflight, pingInterval, pingTimeouts)
+}
+
+func (b natsStreamingBackend) NewProduceHandler(cfg map[string]string) (produceHandler, error) {
+	url, cid, maxInflight, pingInterval, pingTimeouts := natsStreamingConfigFrom(cfg)
+	return newNatsStreamingProduceHandler(url, cid, maxInflight, pingInterval, pingTimeouts, b.Name())
+}
+
+func (b natsStreamingBackend) RegisterCommand(app *cli.Cli, enabled *map[string]bool, set func(consumeHandler, produceHandler)) {
+	app.Command("nats-streaming", "Use NATS streaming backend", func(cmd *cli.Cmd) {
+		url := cmd.String(cli.StringOpt{
+			Name:   "url",
+			Value:  "nats://localhost:4222",
+			Desc:   "NATS url",
+			EnvVar: "PROXIMO_NATS_URL",
+		})
+		cid := cmd.String(cli.StringOpt{
+			Name:   "cid",
+			Value:  "test-cluster",
+			Desc:   "cluster id",
+			EnvVar: "PROXIMO_NATS_CLUSTER_ID",
+		})
+		maxInflight := cmd.Int(cli.IntOpt{
+			Name:   "max-inflight",
+			Value:  stan.DefaultMaxInflight,
+			Desc:   "maximum number of unacknowledged messages",
+			EnvVar: "PROXIMO_NATS_MAX_INFLIGHT",
+		})
+		pingIntervalSeconds := cmd.Int(cli.IntOpt{
+			Name:   "ping-interval",
+			Value:  3,
+			Desc:   "interval in seconds for connection pings",
+			EnvVar: "PROXIMO_NATS_PING_INTERVAL_SECONDS",
+		})
+		pingNumTimeouts := cmd.Int(cli.IntOpt{
+			Name:   "num-ping-timeouts",
+			Value:  5,
+			Desc:   "number of pings to time out before connection considered broken",
+			EnvVar: "PROXIMO_NATS_NUM_PING_TIMEOUTS",
+		})
+		cmd.Action = func() {
+			cfg := map[string]string{
+				"url":               *url,
+				"cid":               *cid,
+				"max_inflight":      strconv.Itoa(*maxInflight),
+				"ping_interval":     strconv.Itoa(*pingIntervalSeconds),
+				"num_ping_timeouts": strconv.Itoa(*pingNumTimeouts),
+			}
+
+			var c consumeHandler
+			var p produceHandler
+			if (*enabled)[consumeEndpoint] {
+				h, err := b.NewConsumeHandler(cfg)
+				if err != nil {
+					log.Fatalf("failed to connect to nats streaming for consumption: %v", err)
+				}
+				c = h
+			}
+			if (*enabled)[publishEndpoint] {
+				h, err := b.NewProduceHandler(cfg)
+				if err != nil {
+					log.Fatalf("failed to connect to nats streaming for production: %v", err)
+				}
+				p = h
+			}
+			set(c, p)
+
+			log.Printf("Using NATS streaming server at %s with cluster id %s and max inflight %v\n", *url, *cid, *maxInflight)
+		}
+	})
+}
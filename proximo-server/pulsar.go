@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	cli "github.com/jawher/mow.cli"
+	"github.com/pkg/errors"
+	"github.com/uw-labs/sync/gogroup"
+
+	"github.com/uw-labs/proximo/proto"
+)
+
+// pulsarProduceMaxInflight bounds how many SendAsync calls a
+// pulsarProduceHandler may have outstanding against the broker at once.
+const pulsarProduceMaxInflight = 256
+
+// pulsarConsumeHandler consumes a topic via a Pulsar subscription. Unlike
+// the Kafka/Kinesis backends, Pulsar tracks consumer position itself once a
+// subscription exists, so there's no separate checkpoint store to manage
+// here.
+type pulsarConsumeHandler struct {
+	serviceURL       string
+	subscriptionType pulsar.SubscriptionType
+	tls              pulsarTLSConfig
+	authToken        string
+}
+
+// pulsarTLSConfig holds the flags needed to connect to a TLS enabled Pulsar
+// cluster.
+type pulsarTLSConfig struct {
+	trustCertsFile   string
+	certFile         string
+	keyFile          string
+	allowInsecure    bool
+	validateHostname bool
+}
+
+func (h *pulsarConsumeHandler) newClient() (pulsar.Client, error) {
+	opts := pulsar.ClientOptions{
+		URL:                        h.serviceURL,
+		TLSTrustCertsFilePath:      h.tls.trustCertsFile,
+		TLSCertificateFile:         h.tls.certFile,
+		TLSKeyFilePath:             h.tls.keyFile,
+		TLSAllowInsecureConnection: h.tls.allowInsecure,
+		TLSValidateHostname:        h.tls.validateHostname,
+	}
+	if h.authToken != "" {
+		opts.Authentication = pulsar.NewAuthenticationToken(h.authToken)
+	}
+	return pulsar.NewClient(opts)
+}
+
+func pulsarSubscriptionType(s string) (pulsar.SubscriptionType, error) {
+	switch s {
+	case "exclusive":
+		return pulsar.Exclusive, nil
+	case "shared":
+		return pulsar.Shared, nil
+	case "failover":
+		return pulsar.Failover, nil
+	case "key_shared":
+		return pulsar.KeyShared, nil
+	default:
+		return 0, errors.Errorf("unsupported pulsar subscription type %q", s)
+	}
+}
+
+func pulsarInitialPosition(offset proto.Offset) pulsar.SubscriptionInitialPosition {
+	if offset == proto.Offset_OFFSET_NEWEST {
+		return pulsar.SubscriptionPositionLatest
+	}
+	return pulsar.SubscriptionPositionEarliest
+}
+
+func (h *pulsarConsumeHandler) HandleConsume(ctx context.Context, conf consumerConfig, forClient chan<- *proto.Message, confirmRequest <-chan *proto.Confirmation, creditCh <-chan uint32) error {
+	client, err := h.newClient()
+	if err != nil {
+		return errors.Wrap(err, "failed to create pulsar client")
+	}
+	defer client.Close()
+
+	consumer, err := client.Subscribe(pulsar.ConsumerOptions{
+		Topic:                       conf.topic,
+		SubscriptionName:            conf.consumer,
+		Type:                        h.subscriptionType,
+		SubscriptionInitialPosition: pulsarInitialPosition(conf.offset),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create pulsar subscription")
+	}
+	defer consumer.Close()
+
+	// pending tracks, in the order messages were handed to the client,
+	// which pulsar MessageID to Ack when a confirmation comes back. The
+	// consume protocol only exposes a single confirmation stream, so acks
+	// are matched to messages on a strict FIFO basis.
+	pending := make(chan pulsar.MessageID, 1024)
+
+	for {
+		msg, err := consumer.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "failed to receive pulsar message")
+		}
+
+		select {
+		case pending <- msg.ID():
+		case <-ctx.Done():
+			return nil
+		}
+
+		select {
+		case forClient <- &proto.Message{Data: msg.Payload()}:
+		case <-ctx.Done():
+			return nil
+		}
+
+		select {
+		case <-confirmRequest:
+			id := <-pending
+			if err := consumer.AckID(id); err != nil {
+				return errors.Wrap(err, "failed to ack pulsar message")
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// pulsarProduceHandler publishes messages to a Pulsar topic using async
+// sends, only surfacing a confirmation to the client once Pulsar has
+// returned a broker ack.
+type pulsarProduceHandler struct {
+	serviceURL string
+	tls        pulsarTLSConfig
+	authToken  string
+	backend    string
+}
+
+func (h *pulsarProduceHandler) newClient() (pulsar.Client, error) {
+	opts := pulsar.ClientOptions{
+		URL:                        h.serviceURL,
+		TLSTrustCertsFilePath:      h.tls.trustCertsFile,
+		TLSCertificateFile:         h.tls.certFile,
+		TLSKeyFilePath:             h.tls.keyFile,
+		TLSAllowInsecureConnection: h.tls.allowInsecure,
+		TLSValidateHostname:        h.tls.validateHostname,
+	}
+	if h.authToken != "" {
+		opts.Authentication = pulsar.NewAuthenticationToken(h.authToken)
+	}
+	return pulsar.NewClient(opts)
+}
+
+func (h *pulsarProduceHandler) HandleProduce(ctx context.Context, conf produceConfig, forClient <-chan *proto.Message, confirmRequest chan<- *proto.Confirmation) error {
+	client, err := h.newClient()
+	if err != nil {
+		return errors.Wrap(err, "failed to create pulsar client")
+	}
+	defer client.Close()
+
+	producer, err := client.CreateProducer(pulsar.ProducerOptions{Topic: conf.topic})
+	if err != nil {
+		return errors.Wrap(err, "failed to create pulsar producer")
+	}
+	defer producer.Close()
+
+	// pending carries, in the order messages were handed to SendAsync, the
+	// one-shot channel its callback will deliver the publish result on. That
+	// lets up to pulsarProduceMaxInflight sends be outstanding against the
+	// broker at once while still acking them back to the client strictly in
+	// send order.
+	pending := make(chan chan error, pulsarProduceMaxInflight)
+
+	g, ctx := gogroup.New(ctx)
+
+	g.Go(func() error {
+		for {
+			select {
+			case m, ok := <-forClient:
+				if !ok {
+					return nil
+				}
+				result := make(chan error, 1)
+				select {
+				case pending <- result:
+				case <-ctx.Done():
+					return nil
+				}
+				producer.SendAsync(ctx, &pulsar.ProducerMessage{Payload: m.Data}, func(_ pulsar.MessageID, _ *pulsar.ProducerMessage, err error) {
+					result <- err
+				})
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+
+	g.Go(func() error {
+		for {
+			select {
+			case result := <-pending:
+				select {
+				case err := <-result:
+					if err != nil {
+						return errors.Wrap(err, "failed to publish message to pulsar")
+					}
+				case <-ctx.Done():
+					return nil
+				}
+				messagesOut.WithLabelValues(h.backend, conf.topic).Inc()
+				select {
+				case confirmRequest <- &proto.Confirmation{}:
+				case <-ctx.Done():
+					return nil
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+
+	return g.Wait()
+}
+
+func pulsarTLSConfigFrom(cfg map[string]string) pulsarTLSConfig {
+	return pulsarTLSConfig{
+		trustCertsFile:   cfg["tls_trust_certs"],
+		certFile:         cfg["tls_cert"],
+		keyFile:          cfg["tls_key"],
+		allowInsecure:    cfg["tls_allow_insecure"] == "true",
+		validateHostname: true,
+	}
+}
+
+type pulsarBackend struct{}
+
+func (pulsarBackend) Name() string { return "pulsar" }
+
+func (pulsarBackend) NewConsumeHandler(cfg map[string]string) (consumeHandler, error) {
+	subType, err := pulsarSubscriptionType(stringOrDefault(cfg["subscription_type"], "exclusive"))
+	if err != nil {
+		return nil, err
+	}
+	return &pulsarConsumeHandler{
+		serviceURL:       stringOrDefault(cfg["service_url"], "pulsar://localhost:6650"),
+		subscriptionType: subType,
+		tls:              pulsarTLSConfigFrom(cfg),
+		authToken:        cfg["auth_token"],
+	}, nil
+}
+
+func (b pulsarBackend) NewProduceHandler(cfg map[string]string) (produceHandler, error) {
+	return &pulsarProduceHandler{
+		serviceURL: stringOrDefault(cfg["service_url"], "pulsar://localhost:6650"),
+		tls:        pulsarTLSConfigFrom(cfg),
+		authToken:  cfg["auth_token"],
+		backend:    b.Name(),
+	}, nil
+}
+
+func (b pulsarBackend) RegisterCommand(app *cli.Cli, enabled *map[string]bool, set func(consumeHandler, produceHandler)) {
+	app.Command("pulsar", "Use Apache Pulsar backend", func(cmd *cli.Cmd) {
+		serviceURL := cmd.String(cli.StringOpt{
+			Name:   "service-url",
+			Value:  "pulsar://localhost:6650",
+			Desc:   "Pulsar service URL",
+			EnvVar: "PROXIMO_PULSAR_SERVICE_URL",
+		})
+		subscriptionType := cmd.String(cli.StringOpt{
+			Name:   "subscription-type",
+			Value:  "exclusive",
+			Desc:   "Pulsar subscription type (exclusive, shared, failover, key_shared)",
+			EnvVar: "PROXIMO_PULSAR_SUBSCRIPTION_TYPE",
+		})
+		tlsTrustCerts := cmd.String(cli.StringOpt{
+			Name:   "tls-trust-certs",
+			Desc:   "Path to a PEM encoded CA certificate used to verify the broker",
+			EnvVar: "PROXIMO_PULSAR_TLS_TRUST_CERTS",
+		})
+		tlsCert := cmd.String(cli.StringOpt{
+			Name:   "tls-cert",
+			Desc:   "Path to a PEM encoded client certificate, for mutual TLS",
+			EnvVar: "PROXIMO_PULSAR_TLS_CERT",
+		})
+		tlsKey := cmd.String(cli.StringOpt{
+			Name:   "tls-key",
+			Desc:   "Path to the PEM encoded private key for --tls-cert",
+			EnvVar: "PROXIMO_PULSAR_TLS_KEY",
+		})
+		tlsAllowInsecure := cmd.Bool(cli.BoolOpt{
+			Name:   "tls-allow-insecure",
+			Value:  false,
+			Desc:   "Allow an insecure (unverified) TLS connection to the broker",
+			EnvVar: "PROXIMO_PULSAR_TLS_ALLOW_INSECURE",
+		})
+		authToken := cmd.String(cli.StringOpt{
+			Name:   "auth-token",
+			Desc:   "Token used to authenticate with the Pulsar broker",
+			EnvVar: "PROXIMO_PULSAR_AUTH_TOKEN",
+		})
+
+		cmd.Action = func() {
+			cfg := map[string]string{
+				"service_url":        *serviceURL,
+				"subscription_type":  *subscriptionType,
+				"tls_trust_certs":    *tlsTrustCerts,
+				"tls_cert":           *tlsCert,
+				"tls_key":            *tlsKey,
+				"tls_allow_insecure": strconv.FormatBool(*tlsAllowInsecure),
+				"auth_token":         *authToken,
+			}
+
+			var c consumeHandler
+			var p produceHandler
+			if (*enabled)[consumeEndpoint] {
+				h, err := b.NewConsumeHandler(cfg)
+				if err != nil {
+					log.Fatal(err)
+				}
+				c = h
+			}
+			if (*enabled)[publishEndpoint] {
+				h, err := b.NewProduceHandler(cfg)
+				if err != nil {
+					log.Fatal(err)
+				}
+				p = h
+			}
+			set(c, p)
+
+			log.Printf("Using pulsar at %s\n", *serviceURL)
+		}
+	})
+}
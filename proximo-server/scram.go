@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// xdgSCRAMClient adapts github.com/xdg-go/scram to sarama's
+// SCRAMClient interface, as recommended by sarama's own SASL/SCRAM examples.
+type xdgSCRAMClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (c *xdgSCRAMClient) Begin(userName, password, authzID string) error {
+	client, err := c.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.Client = client
+	c.ClientConversation = c.Client.NewConversation()
+	return nil
+}
+
+func (c *xdgSCRAMClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+func (c *xdgSCRAMClient) Done() bool {
+	return c.ClientConversation.Done()
+}
+
+func scramClientGenerator(mechanism sarama.SASLMechanism) func() sarama.SCRAMClient {
+	hashGenerator := scram.SHA256
+	if mechanism == sarama.SASLTypeSCRAMSHA512 {
+		hashGenerator = scram.SHA512
+	}
+	return func() sarama.SCRAMClient {
+		return &xdgSCRAMClient{HashGeneratorFcn: hashGenerator}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"strings"
+	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -23,13 +24,24 @@ type consumerConfig struct {
 	consumer string
 	topic    string
 	offset   proto.Offset
+
+	// initialCredit is the number of unacknowledged messages the handler
+	// may hand to the client before it has to wait for a FlowControl
+	// message. Zero means unlimited, which is what a client that predates
+	// FlowControl gets.
+	initialCredit uint32
 }
 
 type consumeHandler interface {
-	HandleConsume(ctx context.Context, conf consumerConfig, forClient chan<- *proto.Message, confirmRequest <-chan *proto.Confirmation) error
+	// creditCh streams flow-control top-ups as they arrive from the client.
+	// A handler that can cheaply stop pulling from its backend (e.g. by
+	// pausing a partition) may use it to avoid fetching messages it knows
+	// it can't yet deliver; it is safe to ignore.
+	HandleConsume(ctx context.Context, conf consumerConfig, forClient chan<- *proto.Message, confirmRequest <-chan *proto.Confirmation, creditCh <-chan uint32) error
 }
 
 type consumeServer struct {
+	backend string
 	handler consumeHandler
 }
 
@@ -41,6 +53,18 @@ func (s *consumeServer) Consume(stream proto.MessageSource_ConsumeServer) error
 	forClient := make(chan *proto.Message)
 	confirmRequest := make(chan *proto.Confirmation)
 	startRequest := make(chan *proto.StartConsumeRequest)
+	flowControl := make(chan *proto.FlowControl)
+
+	// handlerForClient/handlerConfirm are the channels handed to the
+	// backend handler. Messages and confirmations are relayed through them
+	// so that throughput, in-flight count and confirm latency can be
+	// recorded without the handler needing to know about metrics.
+	handlerForClient := make(chan *proto.Message)
+	handlerConfirm := make(chan *proto.Confirmation)
+	// handlerCredit is a single-slot buffer drained via coalesceCredit so a
+	// handler that is momentarily busy (e.g. mid-ConsumeClaim) never has a
+	// flow-control top-up silently dropped on the floor.
+	handlerCredit := make(chan uint32, 1)
 
 	g.Go(func() error {
 		started := false
@@ -75,6 +99,15 @@ func (s *consumeServer) Consume(stream proto.MessageSource_ConsumeServer) error
 				case <-ctx.Done():
 					return nil
 				}
+			case msg.GetFlowControl() != nil:
+				if !started {
+					return errInvalidConfirm
+				}
+				select {
+				case flowControl <- msg.GetFlowControl():
+				case <-ctx.Done():
+					return nil
+				}
 			default:
 				return errInvalidRequest
 			}
@@ -105,11 +138,80 @@ func (s *consumeServer) Consume(stream proto.MessageSource_ConsumeServer) error
 			conf.topic = sr.GetTopic()
 			conf.consumer = sr.GetConsumer()
 			conf.offset = sr.GetInitialOffset()
+			conf.initialCredit = sr.GetMaxInflight()
 		case <-ctx.Done():
 			return nil
 		}
 
-		return s.handler.HandleConsume(ctx, conf, forClient, confirmRequest)
+		backend, topic := s.backend, conf.topic
+		sendTimes := make(chan time.Time, 1024)
+		credit := newCreditController(ctx, conf.initialCredit)
+
+		g.Go(func() error {
+			for {
+				select {
+				case fc := <-flowControl:
+					credit.addCredit(ctx, fc.GetCredits())
+					coalesceCredit(handlerCredit, fc.GetCredits())
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		})
+
+		g.Go(func() error {
+			for {
+				select {
+				case m := <-handlerForClient:
+					if err := credit.acquire(ctx); err != nil {
+						return nil
+					}
+					messagesIn.WithLabelValues(backend, topic).Inc()
+					messagesInFlight.WithLabelValues(backend, topic).Inc()
+					// Best-effort: sendTimes only feeds the confirm-latency
+					// histogram, so a slow-confirming client must never be
+					// able to block message delivery by filling it up.
+					select {
+					case sendTimes <- time.Now():
+					default:
+					}
+					select {
+					case forClient <- m:
+					case <-ctx.Done():
+						return nil
+					}
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		})
+
+		g.Go(func() error {
+			for {
+				select {
+				case c := <-confirmRequest:
+					select {
+					case t := <-sendTimes:
+						confirmLatency.WithLabelValues(backend, topic).Observe(time.Since(t).Seconds())
+					default:
+					}
+					messagesInFlight.WithLabelValues(backend, topic).Dec()
+					select {
+					case handlerConfirm <- c:
+					case <-ctx.Done():
+						return nil
+					}
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		})
+
+		err := s.handler.HandleConsume(ctx, conf, handlerForClient, handlerConfirm, handlerCredit)
+		if err != nil {
+			handlerErrors.WithLabelValues(backend, topic).Inc()
+		}
+		return err
 	})
 
 	if err := g.Wait(); err != nil {